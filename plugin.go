@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
@@ -23,6 +26,7 @@ type (
 		Vars        map[string]string
 		Secrets     map[string]string
 		InitOptions InitOptions
+		FmtOptions  FmtOptions
 		Cacert      string
 		Sensitive   bool
 		RoleARN     string
@@ -31,6 +35,45 @@ type (
 		Targets     []string
 		VarFiles    []string
 		Destroy     bool
+		// Actions is the ordered list of Terraform steps to run, e.g.
+		// ["fmt", "validate", "plan", "apply"]. When empty, the plugin
+		// falls back to the default init/get/validate/plan/apply(-destroy)
+		// pipeline.
+		Actions        []string
+		DisableRefresh bool
+		// Workspace selects (creating it if necessary) a single Terraform
+		// workspace right after init. Workspaces runs the full pipeline once per
+		// named workspace, each with its own .terraform data dir, and takes
+		// precedence over Workspace when both are set.
+		Workspace  string
+		Workspaces []string
+		Netrc      Netrc
+		// TerraformDataDir overrides Terraform's default ".terraform" data
+		// dir via TF_DATA_DIR, letting callers run parallel invocations
+		// against the same working directory.
+		TerraformDataDir string
+		// PlanOutJSON, when set, writes the raw `terraform show -json`
+		// output for the plan to this path.
+		PlanOutJSON string
+		// FailOnDestroy aborts before apply if the plan contains any
+		// delete (or replace) actions.
+		FailOnDestroy bool
+		// MaxChanges aborts before apply if the plan's total non-no-op
+		// changes exceed this threshold. Zero means no limit.
+		MaxChanges int
+		// OnError controls how step failures are handled: "fail-fast" (the
+		// default) aborts on the first failure; "continue" lets fmt and
+		// validate failures accumulate so they can be reported together
+		// instead of stopping the pipeline on the first one.
+		OnError string
+	}
+
+	// Netrc holds credentials for resolving private module sources over
+	// HTTPS (e.g. the DRONE_NETRC_* vars Drone injects for repo cloning).
+	Netrc struct {
+		Machine  string
+		Login    string
+		Password string
 	}
 
 	// InitOptions include options for the Terraform's init command
@@ -40,6 +83,14 @@ type (
 		LockTimeout   string   `json:"lock-timeout"`
 	}
 
+	// FmtOptions include options for the Terraform's fmt command
+	FmtOptions struct {
+		List  *bool `json:"list"`
+		Write *bool `json:"write"`
+		Diff  *bool `json:"diff"`
+		Check bool  `json:"check"`
+	}
+
 	// Plugin represents the plugin instance to be executed
 	Plugin struct {
 		Config    Config
@@ -59,57 +110,322 @@ func (p Plugin) Exec() error {
 	}
 
 	if p.Config.RoleARN != "" {
-		assumeRole(p.Config.RoleARN)
+		if err := assumeRole(p.Config.RoleARN); err != nil {
+			return err
+		}
+		defer scrubAWSCredentials()
+	}
+
+	if p.Config.Netrc.Machine != "" {
+		restoreNetrc, err := writeNetrc(p.Config.Netrc)
+		if err != nil {
+			return err
+		}
+		defer restoreNetrc()
+	}
+
+	var failed []string
+	for _, workspace := range p.Config.workspaceList() {
+		if err := p.execWorkspace(workspace); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", workspaceLabel(workspace), err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("terraform failed for %d workspace(s): %s", len(failed), strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// workspaceList returns the workspaces to run the pipeline against.
+// Workspaces takes precedence over the single Workspace field; when neither
+// is set, the pipeline runs once against the current (default) workspace.
+func (c Config) workspaceList() []string {
+	if len(c.Workspaces) > 0 {
+		return c.Workspaces
+	}
+	if c.Workspace != "" {
+		return []string{c.Workspace}
+	}
+	return []string{""}
+}
+
+func workspaceLabel(workspace string) string {
+	if workspace == "" {
+		return "default"
+	}
+	return workspace
+}
+
+// Step is one entry in the planned Terraform pipeline. buildSteps exposes
+// these so tests (and callers) can introspect what would run without
+// actually executing anything.
+type Step struct {
+	Name string
+	Cmd  *exec.Cmd
+}
+
+// buildSteps turns config.actions() into the concrete commands that would be
+// run for them. When workspace is non-empty, a "workspace" step is inserted
+// right after "init" (or at the front if the pipeline has no init step) —
+// `terraform workspace select/new` requires the backend to already be
+// initialized in the data dir, so it can't run before init.
+func buildSteps(config Config, workspace string) ([]Step, error) {
+	var steps []Step
+	inserted := false
+	for _, action := range config.actions() {
+		cmd, err := actionCommand(action, config)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, Step{Name: action, Cmd: cmd})
+
+		if action == "init" && workspace != "" && !inserted {
+			steps = append(steps, Step{Name: "workspace", Cmd: workspaceCommand(workspace)})
+			inserted = true
+		}
 	}
 
-	var commands []*exec.Cmd
+	if workspace != "" && !inserted {
+		steps = append([]Step{{Name: "workspace", Cmd: workspaceCommand(workspace)}}, steps...)
+	}
+
+	return steps, nil
+}
 
-	commands = append(commands, exec.Command("terraform", "version"))
+// execWorkspace runs the full command pipeline against a single Terraform
+// workspace, isolating its .terraform data dir so that matrix runs across
+// workspaces don't clobber each other's state. Its data dir is always
+// cleaned up on the way out, even when a step fails.
+func (p Plugin) execWorkspace(workspace string) error {
+	dataDir := ".terraform"
+	if p.Config.TerraformDataDir != "" {
+		dataDir = p.Config.TerraformDataDir
+	}
+	if workspace != "" {
+		dataDir = fmt.Sprintf("%s-%s", dataDir, workspace)
+	}
+
+	cleanup := func() {
+		if err := p.runCommand(deleteDir(dataDir), workspace); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":     err,
+				"workspace": workspaceLabel(workspace),
+			}).Warn("Failed to clean up Terraform data dir")
+		}
+	}
+	cleanup()
+	defer cleanup()
 
 	CopyTfEnv()
 
-	if p.Config.Cacert != "" {
-		commands = append(commands, installCaCert(p.Config.Cacert))
+	if dataDir != ".terraform" {
+		os.Setenv("TF_DATA_DIR", dataDir)
 	}
 
-	commands = append(commands, deleteCache())
+	// Drop any TF_WORKSPACE left over from a previous workspace in a matrix
+	// run; it's exported again below once this workspace's select/new succeeds.
+	if workspace != "" {
+		os.Unsetenv("TF_WORKSPACE")
+	}
 
-	commands = append(commands, initCommand(p.Config.InitOptions))
+	if err := p.runCommand(exec.Command("terraform", "version"), workspace); err != nil {
+		return err
+	}
+	if p.Config.Cacert != "" {
+		if err := p.runCommand(installCaCert(p.Config.Cacert), workspace); err != nil {
+			return err
+		}
+	}
 
-	commands = append(commands, getModules())
-	commands = append(commands, validateCommand(p.Config))
-	commands = append(commands, planCommand(p.Config))
-	if !p.Config.Plan {
-		commands = append(commands, terraformCommand(p.Config))
+	steps, err := buildSteps(p.Config, workspace)
+	if err != nil {
+		return err
 	}
-	commands = append(commands, deleteCache())
 
-	for _, c := range commands {
-		if c.Dir == "" {
-			wd, err := os.Getwd()
-			if err == nil {
-				c.Dir = wd
+	var deferred []string
+	for _, step := range steps {
+		// Once a fmt/validate failure has been deferred, refuse to run
+		// anything else — plan/apply/destroy must never execute against a
+		// config that's already known to be broken.
+		if len(deferred) > 0 && step.Name != "fmt" && step.Name != "validate" {
+			return fmt.Errorf("%s", strings.Join(deferred, "; "))
+		}
+
+		err := p.runCommand(step.Cmd, workspace)
+		if err == nil && step.Name == "plan" {
+			err = p.analyzePlan()
+		}
+		if err == nil {
+			// Only point Terraform at the workspace once select/new has
+			// actually succeeded — exporting TF_WORKSPACE beforehand makes
+			// Terraform treat it as authoritative and error out on a brand
+			// new workspace that doesn't exist yet.
+			if step.Name == "workspace" {
+				os.Setenv("TF_WORKSPACE", workspace)
 			}
+			continue
 		}
-		if p.Config.RootDir != "" {
-			c.Dir = c.Dir + "/" + p.Config.RootDir
+
+		if p.Config.OnError == "continue" && (step.Name == "fmt" || step.Name == "validate") {
+			deferred = append(deferred, fmt.Sprintf("%s: %v", step.Name, err))
+			continue
 		}
-		c.Stdout = os.Stdout
-		c.Stderr = os.Stderr
-		if !p.Config.Sensitive {
-			trace(c)
+
+		if len(deferred) > 0 {
+			deferred = append(deferred, err.Error())
+			return fmt.Errorf("%s", strings.Join(deferred, "; "))
 		}
+		return err
+	}
 
-		err := c.Run()
-		if err != nil {
+	if len(deferred) > 0 {
+		return fmt.Errorf("%s", strings.Join(deferred, "; "))
+	}
+
+	return nil
+}
+
+// resolveDir sets c.Dir the same way every pipeline command resolves its
+// working directory, so ad hoc commands (like analyzePlan's `show -json`)
+// look in the same place RootDir-aware steps write their files.
+func (p Plugin) resolveDir(c *exec.Cmd) {
+	if c.Dir == "" {
+		wd, err := os.Getwd()
+		if err == nil {
+			c.Dir = wd
+		}
+	}
+	if p.Config.RootDir != "" {
+		c.Dir = c.Dir + "/" + p.Config.RootDir
+	}
+}
+
+// runCommand sets up a command's working dir and output streams, traces it
+// unless Sensitive is set, and runs it.
+func (p Plugin) runCommand(c *exec.Cmd, workspace string) error {
+	p.resolveDir(c)
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if !p.Config.Sensitive {
+		trace(c)
+	}
+
+	if err := c.Run(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"workspace": workspaceLabel(workspace),
+		}).Error("Failed to execute a command")
+		return err
+	}
+
+	logrus.Debug("Command completed successfully")
+	return nil
+}
+
+// actions returns the configured pipeline, falling back to the default
+// init/get/validate/plan/apply(-destroy) sequence when none is supplied.
+func (c Config) actions() []string {
+	if len(c.Actions) > 0 {
+		return c.Actions
+	}
+
+	actions := []string{"init", "get", "validate", "plan"}
+	if !c.Plan {
+		if c.Destroy {
+			actions = append(actions, "destroy")
+		} else {
+			actions = append(actions, "apply")
+		}
+	}
+	return actions
+}
+
+// actionCommand builds the *exec.Cmd for a single entry in Config.Actions.
+func actionCommand(action string, config Config) (*exec.Cmd, error) {
+	switch action {
+	case "fmt":
+		return fmtCommand(config.FmtOptions), nil
+	case "init":
+		return initCommand(config.InitOptions), nil
+	case "get":
+		return getModules(), nil
+	case "validate":
+		return validateCommand(config), nil
+	case "plan":
+		return planCommand(config), nil
+	case "apply":
+		return applyCommand(config), nil
+	case "destroy":
+		return destroyCommand(config), nil
+	default:
+		return nil, fmt.Errorf("unsupported action %q", action)
+	}
+}
+
+// writeNetrc writes $HOME/.netrc so `terraform init`/`get` can authenticate
+// against private module sources (e.g. GitHub Enterprise, private Bitbucket)
+// over HTTPS. If a .netrc already exists (e.g. mounted in for other tooling),
+// it's backed up and the returned restore func puts it back instead of
+// deleting it.
+func writeNetrc(netrc Netrc) (func(), error) {
+	path := netrcPath()
+
+	backup, mode, hadExisting, err := readExistingNetrc(path)
+	if err != nil {
+		return nil, err
+	}
+
+	content := fmt.Sprintf(
+		"machine %s\nlogin %s\npassword %s\n",
+		netrc.Machine,
+		netrc.Login,
+		netrc.Password,
+	)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		return nil, err
+	}
+
+	restore := func() {
+		if !hadExisting {
+			if err := os.Remove(path); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": err,
+				}).Warn("Failed to remove .netrc")
+			}
+			return
+		}
+		if err := ioutil.WriteFile(path, backup, mode); err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error": err,
-			}).Fatal("Failed to execute a command")
+			}).Warn("Failed to restore original .netrc")
 		}
-		logrus.Debug("Command completed successfully")
 	}
 
-	return nil
+	return restore, nil
+}
+
+// readExistingNetrc returns the contents and mode of a pre-existing .netrc
+// at path, if any, so writeNetrc can restore it afterwards.
+func readExistingNetrc(path string) ([]byte, os.FileMode, bool, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return data, info.Mode(), true, nil
+}
+
+func netrcPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".netrc")
 }
 
 func installCaCert(cacert string) *exec.Cmd {
@@ -130,11 +446,21 @@ func CopyTfEnv() {
 	}
 }
 
-func deleteCache() *exec.Cmd {
+func deleteDir(dir string) *exec.Cmd {
 	return exec.Command(
 		"rm",
 		"-rf",
-		".terraform",
+		dir,
+	)
+}
+
+// workspaceCommand selects the named Terraform workspace, creating it first
+// if it doesn't exist yet.
+func workspaceCommand(workspace string) *exec.Cmd {
+	return exec.Command(
+		"sh",
+		"-c",
+		fmt.Sprintf("terraform workspace select %s || terraform workspace new %s", workspace, workspace),
 	)
 }
 
@@ -147,15 +473,9 @@ func initCommand(config InitOptions) *exec.Cmd {
 		args = append(args, fmt.Sprintf("-backend-config=%s", v))
 	}
 
-	// True is default in TF
-	if config.Lock != nil {
-		args = append(args, fmt.Sprintf("-lock=%t", *config.Lock))
-	}
-
-	// "0s" is default in TF
-	if config.LockTimeout != "" {
-		args = append(args, fmt.Sprintf("-lock-timeout=%s", config.LockTimeout))
-	}
+	// Terraform 0.15+ rejects -lock/-lock-timeout on init since init never
+	// mutates remote state, so they're deliberately not passed here even
+	// though InitOptions still carries them for plan/apply/destroy.
 
 	// Fail Terraform execution on prompt
 	args = append(args, "-input=false")
@@ -166,6 +486,32 @@ func initCommand(config InitOptions) *exec.Cmd {
 	)
 }
 
+func fmtCommand(config FmtOptions) *exec.Cmd {
+	args := []string{
+		"fmt",
+	}
+
+	if config.List != nil {
+		args = append(args, fmt.Sprintf("-list=%t", *config.List))
+	}
+	if config.Write != nil {
+		args = append(args, fmt.Sprintf("-write=%t", *config.Write))
+	}
+	if config.Diff != nil {
+		args = append(args, fmt.Sprintf("-diff=%t", *config.Diff))
+	}
+	// -check exits non-zero on drift instead of rewriting files, which is
+	// what makes this usable as a CI gate.
+	if config.Check {
+		args = append(args, "-check")
+	}
+
+	return exec.Command(
+		"terraform",
+		args...,
+	)
+}
+
 func getModules() *exec.Cmd {
 	return exec.Command(
 		"terraform",
@@ -216,18 +562,122 @@ func planCommand(config Config) *exec.Cmd {
 	if config.InitOptions.LockTimeout != "" {
 		args = append(args, fmt.Sprintf("-lock-timeout=%s", config.InitOptions.LockTimeout))
 	}
+	if config.DisableRefresh {
+		args = append(args, "-refresh=false")
+	}
 	return exec.Command(
 		"terraform",
 		args...,
 	)
 }
 
-func terraformCommand(config Config) *exec.Cmd {
+// resourceChange mirrors the subset of `terraform show -json`'s
+// resource_changes[] entries the plugin cares about.
+type resourceChange struct {
+	Address string   `json:"address"`
+	Actions []string `json:"actions"`
+}
+
+type planJSON struct {
+	ResourceChanges []resourceChange `json:"resource_changes"`
+}
+
+// analyzePlan runs `terraform show -json` against the plan produced by
+// planCommand, prints a change summary and gates on FailOnDestroy/MaxChanges.
+// It is a no-op for -destroy plans, which don't produce a plan.tfout. It's a
+// method (rather than a plain function) so it resolves its working dir the
+// same way planCommand's step did, including RootDir.
+func (p Plugin) analyzePlan() error {
+	config := p.Config
 	if config.Destroy {
-		return destroyCommand(config)
+		return nil
+	}
+
+	cmd := exec.Command("terraform", "show", "-json", "plan.tfout")
+	p.resolveDir(cmd)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("terraform show -json plan.tfout: %w", err)
+	}
+
+	if config.PlanOutJSON != "" {
+		if err := ioutil.WriteFile(config.PlanOutJSON, out.Bytes(), 0644); err != nil {
+			return err
+		}
 	}
 
-	return applyCommand(config)
+	summary, err := gatePlan(out.Bytes(), config)
+	if summary != "" {
+		fmt.Println(summary)
+	}
+	return err
+}
+
+// gatePlan decodes a `terraform show -json` payload, returns its human
+// change summary, and applies the FailOnDestroy/MaxChanges gates. Split out
+// from analyzePlan so the decoding and gating logic can be unit tested
+// without actually invoking Terraform.
+func gatePlan(raw []byte, config Config) (string, error) {
+	var plan planJSON
+	if err := json.Unmarshal(raw, &plan); err != nil {
+		return "", fmt.Errorf("parsing plan JSON: %w", err)
+	}
+
+	var add, change, destroy int
+	for _, rc := range plan.ResourceChanges {
+		switch planChangeKind(rc.Actions) {
+		case "create":
+			add++
+		case "update":
+			change++
+		case "delete":
+			destroy++
+		case "replace":
+			add++
+			destroy++
+		}
+	}
+
+	summary := fmt.Sprintf("Plan: %d to add, %d to change, %d to destroy", add, change, destroy)
+
+	if config.FailOnDestroy && destroy > 0 {
+		return summary, fmt.Errorf("plan contains %d destroy action(s) and fail_on_destroy is set", destroy)
+	}
+
+	total := add + change + destroy
+	if config.MaxChanges > 0 && total > config.MaxChanges {
+		return summary, fmt.Errorf("plan contains %d change(s), exceeding max_changes=%d", total, config.MaxChanges)
+	}
+
+	return summary, nil
+}
+
+// planChangeKind classifies a resource_changes[].actions entry, collapsing
+// the create+delete pair Terraform uses for replacements.
+func planChangeKind(actions []string) string {
+	creates, deletes := false, false
+	for _, a := range actions {
+		switch a {
+		case "create":
+			creates = true
+		case "delete":
+			deletes = true
+		case "update":
+			return "update"
+		}
+	}
+	switch {
+	case creates && deletes:
+		return "replace"
+	case creates:
+		return "create"
+	case deletes:
+		return "delete"
+	default:
+		return "no-op"
+	}
 }
 
 func applyCommand(config Config) *exec.Cmd {
@@ -246,6 +696,9 @@ func applyCommand(config Config) *exec.Cmd {
 	if config.InitOptions.LockTimeout != "" {
 		args = append(args, fmt.Sprintf("-lock-timeout=%s", config.InitOptions.LockTimeout))
 	}
+	if config.DisableRefresh {
+		args = append(args, "-refresh=false")
+	}
 	args = append(args, "plan.tfout")
 	return exec.Command(
 		"terraform",
@@ -269,6 +722,9 @@ func destroyCommand(config Config) *exec.Cmd {
 	if config.InitOptions.LockTimeout != "" {
 		args = append(args, fmt.Sprintf("-lock-timeout=%s", config.InitOptions.LockTimeout))
 	}
+	if config.DisableRefresh {
+		args = append(args, "-refresh=false")
+	}
 	args = append(args, "-force")
 	return exec.Command(
 		"terraform",
@@ -276,7 +732,7 @@ func destroyCommand(config Config) *exec.Cmd {
 	)
 }
 
-func assumeRole(roleArn string) {
+func assumeRole(roleArn string) error {
 	client := sts.New(session.New())
 	duration := time.Hour * 1
 	stsProvider := &stscreds.AssumeRoleProvider{
@@ -288,13 +744,20 @@ func assumeRole(roleArn string) {
 
 	value, err := credentials.NewCredentials(stsProvider).Get()
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"error": err,
-		}).Fatal("Error assuming role!")
+		return fmt.Errorf("assuming role %s: %w", roleArn, err)
 	}
 	os.Setenv("AWS_ACCESS_KEY_ID", value.AccessKeyID)
 	os.Setenv("AWS_SECRET_ACCESS_KEY", value.SecretAccessKey)
 	os.Setenv("AWS_SESSION_TOKEN", value.SessionToken)
+	return nil
+}
+
+// scrubAWSCredentials unsets the temporary credentials assumeRole exported,
+// so they don't leak into any commands run after the plugin exits.
+func scrubAWSCredentials() {
+	os.Unsetenv("AWS_ACCESS_KEY_ID")
+	os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	os.Unsetenv("AWS_SESSION_TOKEN")
 }
 
 func trace(cmd *exec.Cmd) {
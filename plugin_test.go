@@ -0,0 +1,194 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigActions(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   []string
+	}{
+		{
+			name:   "default plan and apply",
+			config: Config{},
+			want:   []string{"init", "get", "validate", "plan", "apply"},
+		},
+		{
+			name:   "default destroy",
+			config: Config{Destroy: true},
+			want:   []string{"init", "get", "validate", "plan", "destroy"},
+		},
+		{
+			name:   "default plan-only",
+			config: Config{Plan: true},
+			want:   []string{"init", "get", "validate", "plan"},
+		},
+		{
+			name:   "explicit actions override the default pipeline",
+			config: Config{Actions: []string{"fmt", "validate", "plan"}},
+			want:   []string{"fmt", "validate", "plan"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.config.actions()
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("actions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildStepsInsertsWorkspaceAfterInit(t *testing.T) {
+	steps, err := buildSteps(Config{}, "staging")
+	if err != nil {
+		t.Fatalf("buildSteps() error = %v", err)
+	}
+
+	var names []string
+	for _, s := range steps {
+		names = append(names, s.Name)
+	}
+	want := "init,workspace,get,validate,plan,apply"
+	if got := strings.Join(names, ","); got != want {
+		t.Errorf("buildSteps() step order = %q, want %q", got, want)
+	}
+}
+
+func TestBuildStepsInsertsWorkspaceOnlyOnce(t *testing.T) {
+	steps, err := buildSteps(Config{Actions: []string{"init", "validate", "init", "apply"}}, "staging")
+	if err != nil {
+		t.Fatalf("buildSteps() error = %v", err)
+	}
+
+	var workspaceSteps int
+	for _, s := range steps {
+		if s.Name == "workspace" {
+			workspaceSteps++
+		}
+	}
+	if workspaceSteps != 1 {
+		t.Errorf("buildSteps() with repeated init actions produced %d workspace steps, want 1 (%+v)", workspaceSteps, steps)
+	}
+}
+
+func TestBuildStepsNoWorkspace(t *testing.T) {
+	steps, err := buildSteps(Config{}, "")
+	if err != nil {
+		t.Fatalf("buildSteps() error = %v", err)
+	}
+
+	for _, s := range steps {
+		if s.Name == "workspace" {
+			t.Fatalf("buildSteps() with no workspace should not include a workspace step, got %+v", steps)
+		}
+	}
+}
+
+func TestPlanChangeKind(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions []string
+		want    string
+	}{
+		{"create", []string{"create"}, "create"},
+		{"update", []string{"update"}, "update"},
+		{"delete", []string{"delete"}, "delete"},
+		{"replace", []string{"create", "delete"}, "replace"},
+		{"no-op", []string{"no-op"}, "no-op"},
+		{"empty", nil, "no-op"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := planChangeKind(tt.actions); got != tt.want {
+				t.Errorf("planChangeKind(%v) = %q, want %q", tt.actions, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGatePlanSummary(t *testing.T) {
+	raw := []byte(`{
+		"resource_changes": [
+			{"address": "a", "actions": ["create"]},
+			{"address": "b", "actions": ["create"]},
+			{"address": "c", "actions": ["update"]},
+			{"address": "d", "actions": ["delete"]},
+			{"address": "e", "actions": ["delete"]},
+			{"address": "f", "actions": ["no-op"]}
+		]
+	}`)
+
+	summary, err := gatePlan(raw, Config{})
+	if err != nil {
+		t.Fatalf("gatePlan() error = %v", err)
+	}
+	want := "Plan: 2 to add, 1 to change, 2 to destroy"
+	if summary != want {
+		t.Errorf("gatePlan() summary = %q, want %q", summary, want)
+	}
+}
+
+func TestGatePlanFailOnDestroy(t *testing.T) {
+	raw := []byte(`{"resource_changes": [{"address": "a", "actions": ["delete"]}]}`)
+
+	if _, err := gatePlan(raw, Config{FailOnDestroy: true}); err == nil {
+		t.Fatal("gatePlan() expected an error when FailOnDestroy is set and the plan has a delete")
+	}
+	if _, err := gatePlan(raw, Config{}); err != nil {
+		t.Fatalf("gatePlan() unexpected error without FailOnDestroy: %v", err)
+	}
+}
+
+func TestGatePlanMaxChanges(t *testing.T) {
+	raw := []byte(`{
+		"resource_changes": [
+			{"address": "a", "actions": ["create"]},
+			{"address": "b", "actions": ["create"]},
+			{"address": "c", "actions": ["create"]}
+		]
+	}`)
+
+	if _, err := gatePlan(raw, Config{MaxChanges: 2}); err == nil {
+		t.Fatal("gatePlan() expected an error when changes exceed MaxChanges")
+	}
+	if _, err := gatePlan(raw, Config{MaxChanges: 3}); err != nil {
+		t.Fatalf("gatePlan() unexpected error at the MaxChanges boundary: %v", err)
+	}
+}
+
+func TestGatePlanInvalidJSON(t *testing.T) {
+	if _, err := gatePlan([]byte("not json"), Config{}); err == nil {
+		t.Fatal("gatePlan() expected an error for invalid JSON")
+	}
+}
+
+func TestWorkspaceList(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   []string
+	}{
+		{"default", Config{}, []string{""}},
+		{"single workspace", Config{Workspace: "staging"}, []string{"staging"}},
+		{
+			"multiple workspaces take precedence",
+			Config{Workspace: "staging", Workspaces: []string{"dev", "prod"}},
+			[]string{"dev", "prod"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.config.workspaceList()
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("workspaceList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}